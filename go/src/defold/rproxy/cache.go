@@ -0,0 +1,281 @@
+// Copyright 2020 The Defold Foundation
+// Licensed under the Defold License version 1.0 (the "License"); you may not use
+// this file except in compliance with the License.
+//
+// You may obtain a copy of the License, together with FAQs at
+// https://www.defold.com/license
+//
+// Unless required by applicable law or agreed to in writing, software distributed
+// under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied. See the License for the
+// specific language governing permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheKey identifies the group of responses for one route: everything but
+// the Vary-selected request headers is assumed identical within a group.
+// rawQuery is part of the key because it routinely changes the response
+// (pagination, filters, IDs), unlike a Vary-selected header.
+type cacheKey struct {
+	method   string
+	host     string
+	path     string
+	rawQuery string
+}
+
+// cachedResponse is a complete, buffered upstream response.
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (c *cachedResponse) expired() bool { return time.Now().After(c.expires) }
+
+// toResponse builds a fresh *http.Response for req from the cached bytes;
+// the caller gets its own io.ReadCloser so concurrent readers never race.
+func (c *cachedResponse) toResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(c.status),
+		StatusCode:    c.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+		Request:       req,
+	}
+}
+
+// cacheGroup holds every cached Vary-variant response for a single cacheKey.
+type cacheGroup struct {
+	mu      sync.Mutex
+	vary    []string // header names, from the Vary header of the most recently stored response that had one
+	entries map[string]*cachedResponse
+}
+
+func varyKey(header http.Header, names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, n := range names {
+		b.WriteString(n)
+		b.WriteByte('=')
+		b.WriteString(header.Get(n))
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// respCache caches whole upstream responses per route and coalesces
+// concurrent identical misses with singleflight.
+type respCache struct {
+	mu     sync.Mutex
+	groups map[cacheKey]*cacheGroup
+	sf     singleflight.Group
+
+	hits, misses, coalesced uint64
+	bytes                   int64
+}
+
+func newRespCache() *respCache {
+	return &respCache{groups: make(map[cacheKey]*cacheGroup)}
+}
+
+func (c *respCache) group(key cacheKey) *cacheGroup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[key]
+	if !ok {
+		g = &cacheGroup{entries: make(map[string]*cachedResponse)}
+		c.groups[key] = g
+	}
+	return g
+}
+
+func (c *respCache) get(key cacheKey, reqHeader http.Header) (*cachedResponse, bool) {
+	g := c.group(key)
+	g.mu.Lock()
+	vk := varyKey(reqHeader, g.vary)
+	e, ok := g.entries[vk]
+	g.mu.Unlock()
+	if !ok || e.expired() {
+		return nil, false
+	}
+	return e, true
+}
+
+func (c *respCache) store(key cacheKey, reqHeader http.Header, resp *cachedResponse, ttl time.Duration) {
+	g := c.group(key)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if v := resp.header.Get("Vary"); v != "" {
+		g.vary = splitVaryNames(v)
+	}
+	resp.expires = time.Now().Add(ttl)
+	g.entries[varyKey(reqHeader, g.vary)] = resp
+	atomic.AddInt64(&c.bytes, int64(len(resp.body)))
+}
+
+func splitVaryNames(vary string) []string {
+	parts := strings.Split(vary, ",")
+	names := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			names = append(names, p)
+		}
+	}
+	return names
+}
+
+// invalidate drops every cached response whose path starts with prefix and
+// reports how many were dropped.
+func (c *respCache) invalidate(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, g := range c.groups {
+		if strings.HasPrefix(key.path, prefix) {
+			g.mu.Lock()
+			n += len(g.entries)
+			g.mu.Unlock()
+			delete(c.groups, key)
+		}
+	}
+	return n
+}
+
+// cacheControl describes the parts of a Cache-Control response header that
+// affect whether, and for how long, respCache may store a response.
+type cacheControl struct {
+	noStore   bool
+	private   bool
+	maxAge    time.Duration
+	hasMaxAge bool
+}
+
+func parseCacheControl(header http.Header) cacheControl {
+	var cc cacheControl
+	for _, part := range strings.Split(header.Get("Cache-Control"), ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "no-store":
+			cc.noStore = true
+		case part == "private":
+			cc.private = true
+		case strings.HasPrefix(part, "max-age="):
+			if secs, err := strconv.Atoi(strings.TrimPrefix(part, "max-age=")); err == nil {
+				cc.maxAge = time.Duration(secs) * time.Second
+				cc.hasMaxAge = true
+			}
+		}
+	}
+	return cc
+}
+
+// ttl returns the duration a response may be cached for, given the route's
+// configured ttl and the upstream's Cache-Control header, or false if the
+// response must not be cached at all.
+func (cc cacheControl) ttl(routeTTL time.Duration) (time.Duration, bool) {
+	if cc.noStore || cc.private {
+		return 0, false
+	}
+	if cc.hasMaxAge && cc.maxAge < routeTTL {
+		return cc.maxAge, cc.maxAge > 0
+	}
+	return routeTTL, true
+}
+
+// sfVaryHeaders are the request headers folded into the singleflight key
+// alongside the URL, so concurrent requests that could legitimately get
+// different responses (different credentials, language, encoding) are never
+// coalesced into one upstream call and one shared response body.
+var sfVaryHeaders = []string{"Authorization", "Cookie", "Accept-Language", "Accept-Encoding"}
+
+// cachingTransport wraps an http.RoundTripper with the response cache. It
+// sits between ReverseProxy and the real transport: on a cache hit it
+// returns the cached response without touching rt; on a miss, concurrent
+// identical requests are coalesced with singleflight so only one reaches rt.
+type cachingTransport struct {
+	rt    http.RoundTripper
+	cache *respCache
+	ttl   time.Duration
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := cacheKey{method: req.Method, host: req.URL.Host, path: req.URL.Path, rawQuery: req.URL.RawQuery}
+	if cached, ok := t.cache.get(key, req.Header); ok {
+		atomic.AddUint64(&t.cache.hits, 1)
+		return cached.toResponse(req), nil
+	}
+	atomic.AddUint64(&t.cache.misses, 1)
+
+	sfKey := req.Method + " " + req.URL.String() + " " + varyKey(req.Header, sfVaryHeaders)
+	v, err, shared := t.cache.sf.Do(sfKey, func() (interface{}, error) {
+		resp, err := t.rt.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		cr := &cachedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+		if ttl, ok := parseCacheControl(resp.Header).ttl(t.ttl); ok {
+			t.cache.store(key, req.Header, cr, ttl)
+		}
+		return cr, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		atomic.AddUint64(&t.cache.coalesced, 1)
+	}
+	return v.(*cachedResponse).toResponse(req), nil
+}
+
+// handleCacheStats serves hit/miss/coalesce/byte counters as JSON.
+func (c *respCache) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Hits      uint64 `json:"hits"`
+		Misses    uint64 `json:"misses"`
+		Coalesced uint64 `json:"coalesced"`
+		Bytes     int64  `json:"bytes"`
+	}{
+		atomic.LoadUint64(&c.hits),
+		atomic.LoadUint64(&c.misses),
+		atomic.LoadUint64(&c.coalesced),
+		atomic.LoadInt64(&c.bytes),
+	})
+}
+
+// handleCacheInvalidate implements DELETE /proxy/cache?prefix=...
+func (c *respCache) handleCacheInvalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := c.invalidate(r.URL.Query().Get("prefix"))
+	fmt.Fprintf(w, "invalidated %d entries\n", n)
+}
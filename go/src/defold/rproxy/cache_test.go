@@ -0,0 +1,169 @@
+// Copyright 2020 The Defold Foundation
+// Licensed under the Defold License version 1.0 (the "License"); you may not use
+// this file except in compliance with the License.
+//
+// You may obtain a copy of the License, together with FAQs at
+// https://www.defold.com/license
+//
+// Unless required by applicable law or agreed to in writing, software distributed
+// under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied. See the License for the
+// specific language governing permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newProxyWithBackend(t *testing.T, backendURL, opts string) *proxy {
+	t.Helper()
+	cfgPath := filepath.Join(t.TempDir(), "test.config")
+	cfg := "/cached " + backendURL + " " + opts + "\n"
+	if err := ioutil.WriteFile(cfgPath, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rp, err := newProxy(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+func TestCachingTransportCoalescesParallelRequests(t *testing.T) {
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	rp := newProxyWithBackend(t, backend.URL, "cache=1m")
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			rp.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/cached/x", nil))
+			bodies[i] = w.Body.String()
+		}(i)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt64(&hits); got != 1 {
+		t.Errorf("expected exactly 1 upstream call for 2 parallel identical requests, got %d", got)
+	}
+	for i, b := range bodies {
+		if b != "hello" {
+			t.Errorf("response %d: expected body %q, got %q", i, "hello", b)
+		}
+	}
+}
+
+// TestCachingTransportDoesNotCoalesceDifferingAuth verifies that two
+// concurrent requests to the same URL but with different Authorization
+// headers each reach the backend and each get their own response, rather
+// than being singleflight-coalesced into one shared response body.
+func TestCachingTransportDoesNotCoalesceDifferingAuth(t *testing.T) {
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Cache-Control", "private")
+		w.Write([]byte("value-for-" + r.Header.Get("Authorization")))
+	}))
+	defer backend.Close()
+
+	rp := newProxyWithBackend(t, backend.URL, "cache=1m")
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/cached/x", nil)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer user-%d", i))
+			w := httptest.NewRecorder()
+			rp.ServeHTTP(w, req)
+			bodies[i] = w.Body.String()
+		}(i)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt64(&hits); got != 2 {
+		t.Errorf("expected 2 upstream calls for requests with different Authorization headers, got %d", got)
+	}
+	for i, b := range bodies {
+		want := fmt.Sprintf("value-for-Bearer user-%d", i)
+		if b != want {
+			t.Errorf("response %d: expected its own body %q, got %q", i, want, b)
+		}
+	}
+}
+
+func TestCachingTransportRespectsNoStore(t *testing.T) {
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("fresh"))
+	}))
+	defer backend.Close()
+
+	rp := newProxyWithBackend(t, backend.URL, "cache=1m")
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/cached/x", nil))
+	}
+	if got := atomic.LoadInt64(&hits); got != 2 {
+		t.Errorf("expected a Cache-Control: no-store response to bypass the cache every time, got %d upstream calls", got)
+	}
+}
+
+func TestCachingTransportKeysByQueryString(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("value-for-" + r.URL.RawQuery))
+	}))
+	defer backend.Close()
+
+	rp := newProxyWithBackend(t, backend.URL, "cache=1m")
+
+	w1 := httptest.NewRecorder()
+	rp.ServeHTTP(w1, httptest.NewRequest(http.MethodGet, "http://localhost/cached/x?id=1", nil))
+	if got, want := w1.Body.String(), "value-for-id=1"; got != want {
+		t.Fatalf("id=1: expected %q, got %q", want, got)
+	}
+
+	w2 := httptest.NewRecorder()
+	rp.ServeHTTP(w2, httptest.NewRequest(http.MethodGet, "http://localhost/cached/x?id=2", nil))
+	if got, want := w2.Body.String(), "value-for-id=2"; got != want {
+		t.Fatalf("id=2: expected %q, got %q (served id=1's cached response)", want, got)
+	}
+}
+
+func TestRespCacheInvalidate(t *testing.T) {
+	c := newRespCache()
+	key := cacheKey{method: "GET", host: "h", path: "/a/b"}
+	c.store(key, http.Header{}, &cachedResponse{status: 200, header: http.Header{}, body: []byte("x")}, time.Minute)
+
+	if n := c.invalidate("/a"); n != 1 {
+		t.Errorf("expected 1 entry invalidated, got %d", n)
+	}
+	if _, ok := c.get(key, http.Header{}); ok {
+		t.Error("expected entry to be gone after invalidate")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 The Defold Foundation
+// Licensed under the Defold License version 1.0 (the "License"); you may not use
+// this file except in compliance with the License.
+//
+// You may obtain a copy of the License, together with FAQs at
+// https://www.defold.com/license
+//
+// Unless required by applicable law or agreed to in writing, software distributed
+// under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied. See the License for the
+// specific language governing permissions and limitations under the License.
+
+// Package dl implements the release downloads metadata frontend rproxy
+// mounts at Prefix, alongside the existing static /downloads file server.
+// It accepts authenticated submissions of release metadata, persists them
+// to a JSON file on disk, and serves them back as a filtered, sorted JSON
+// feed or an HTML listing.
+package dl
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix is the path prefix rproxy mounts the downloads frontend at. It is
+// more specific than the static "/downloads" rule, so it takes the request
+// instead of the static file backend.
+const Prefix = "/downloads/api"
+
+// Kind identifies what a release artifact is.
+type Kind string
+
+// Known release kinds.
+const (
+	KindEngine Kind = "engine"
+	KindEditor Kind = "editor"
+	KindTools  Kind = "tools"
+)
+
+// Channel is a release's stability channel.
+type Channel string
+
+// Known stability channels.
+const (
+	ChannelStable Channel = "stable"
+	ChannelBeta   Channel = "beta"
+	ChannelAlpha  Channel = "alpha"
+)
+
+// Release is one submitted piece of release metadata.
+type Release struct {
+	Version   string    `json:"version"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Filename  string    `json:"filename"`
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	Kind      Kind      `json:"kind"`
+	Channel   Channel   `json:"channel"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (r Release) validate() error {
+	switch {
+	case r.Version == "":
+		return fmt.Errorf("missing version")
+	case r.OS == "":
+		return fmt.Errorf("missing os")
+	case r.Filename == "":
+		return fmt.Errorf("missing filename")
+	case r.SHA256 == "":
+		return fmt.Errorf("missing sha256")
+	case r.Kind == "":
+		return fmt.Errorf("missing kind")
+	case r.Channel == "":
+		return fmt.Errorf("missing channel")
+	}
+	return nil
+}
+
+// Store persists Releases to a single JSON file, rewritten atomically on
+// every change.
+type Store struct {
+	mu       sync.Mutex
+	path     string
+	releases []Release
+}
+
+// OpenStore loads the releases persisted at path, or starts empty if the
+// file does not exist yet.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dl: reading %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &s.releases); err != nil {
+		return nil, fmt.Errorf("dl: parsing %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Add appends r to the store and persists the result.
+func (s *Store) Add(r Release) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releases = append(s.releases, r)
+	return s.save()
+}
+
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.releases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// List returns releases matching the given channel and os filters (either
+// may be empty to mean "any"), newest first.
+func (s *Store) List(channel Channel, osName string) []Release {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Release
+	for _, r := range s.releases {
+		if channel != "" && r.Channel != channel {
+			continue
+		}
+		if osName != "" && r.OS != osName {
+			continue
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Timestamp.After(out[j].Timestamp)
+	})
+	return out
+}
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html><head><title>Defold downloads</title></head><body>
+<table>
+<tr><th>Version</th><th>OS/Arch</th><th>Kind</th><th>Channel</th><th>File</th></tr>
+{{range .}}<tr><td>{{.Version}}</td><td>{{.OS}}/{{.Arch}}</td><td>{{.Kind}}</td><td>{{.Channel}}</td><td><a href="/downloads/{{.Filename}}">{{.Filename}}</a></td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// Frontend is the HTTP handler rproxy mounts at Prefix.
+type Frontend struct {
+	store     *Store
+	authToken string
+}
+
+// NewFrontend builds a Frontend backed by store. authToken, if non-empty,
+// must be presented as "Authorization: Bearer <authToken>" on submissions.
+func NewFrontend(store *Store, authToken string) *Frontend {
+	return &Frontend{store: store, authToken: authToken}
+}
+
+// ServeHTTP implements submission (POST Prefix), the JSON feed (GET
+// Prefix+"/list") and the HTML view (GET Prefix or Prefix+"/").
+func (f *Frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodPost && path == Prefix:
+		f.serveSubmit(w, r)
+	case r.Method == http.MethodGet && path == Prefix+"/list":
+		f.serveList(w, r)
+	case r.Method == http.MethodGet && path == Prefix:
+		f.serveHTML(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *Frontend) authorized(r *http.Request) bool {
+	if f.authToken == "" {
+		return true
+	}
+	return r.Header.Get("Authorization") == "Bearer "+f.authToken
+}
+
+func (f *Frontend) serveSubmit(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var rel Release
+	if err := json.NewDecoder(r.Body).Decode(&rel); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := rel.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rel.Timestamp.IsZero() {
+		rel.Timestamp = time.Now()
+	}
+	if err := f.store.Add(rel); err != nil {
+		http.Error(w, "storing release: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *Frontend) serveList(w http.ResponseWriter, r *http.Request) {
+	releases := f.store.List(Channel(r.URL.Query().Get("channel")), r.URL.Query().Get("os"))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(releases); err != nil {
+		http.Error(w, "encoding releases: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (f *Frontend) serveHTML(w http.ResponseWriter, r *http.Request) {
+	releases := f.store.List(Channel(r.URL.Query().Get("channel")), r.URL.Query().Get("os"))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := listTemplate.Execute(w, releases); err != nil {
+		http.Error(w, "rendering releases: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 The Defold Foundation
+// Licensed under the Defold License version 1.0 (the "License"); you may not use
+// this file except in compliance with the License.
+//
+// You may obtain a copy of the License, together with FAQs at
+// https://www.defold.com/license
+//
+// Unless required by applicable law or agreed to in writing, software distributed
+// under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied. See the License for the
+// specific language governing permissions and limitations under the License.
+
+package dl
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := OpenStore(filepath.Join(t.TempDir(), "releases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func validRelease() Release {
+	return Release{
+		Version:  "1.3.0",
+		OS:       "linux",
+		Filename: "1.3.0.zip",
+		SHA256:   "deadbeef",
+		Kind:     KindEngine,
+		Channel:  ChannelStable,
+	}
+}
+
+func TestStoreListFiltersAndOrdersNewestStableFirst(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now()
+
+	releases := []Release{
+		{Version: "1.2.0", OS: "linux", Kind: KindEngine, Channel: ChannelStable, Timestamp: now.Add(-2 * time.Hour)},
+		{Version: "1.3.0", OS: "linux", Kind: KindEngine, Channel: ChannelStable, Timestamp: now},
+		{Version: "1.3.0-beta1", OS: "linux", Kind: KindEngine, Channel: ChannelBeta, Timestamp: now.Add(time.Hour)},
+		{Version: "1.3.0", OS: "win32", Kind: KindEngine, Channel: ChannelStable, Timestamp: now},
+	}
+	for _, r := range releases {
+		r.Filename, r.SHA256 = r.Version+".zip", "deadbeef"
+		if err := s.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := s.List(ChannelStable, "linux")
+	if len(got) != 2 {
+		t.Fatalf("expected 2 stable linux releases, got %d: %+v", len(got), got)
+	}
+	if got[0].Version != "1.3.0" || got[1].Version != "1.2.0" {
+		t.Errorf("expected newest stable first, got %v then %v", got[0].Version, got[1].Version)
+	}
+}
+
+func TestFrontendSubmitRequiresAuth(t *testing.T) {
+	f := NewFrontend(newTestStore(t), "secret")
+	body, _ := json.Marshal(validRelease())
+
+	req := httptest.NewRequest(http.MethodPost, Prefix, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without auth, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, Prefix, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 with auth, got %d", w.Code)
+	}
+}
+
+func TestFrontendSubmitRejectsInvalidBody(t *testing.T) {
+	f := NewFrontend(newTestStore(t), "")
+	req := httptest.NewRequest(http.MethodPost, Prefix, strings.NewReader("not json"))
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid body, got %d", w.Code)
+	}
+}
+
+func TestFrontendSubmitRejectsMissingField(t *testing.T) {
+	f := NewFrontend(newTestStore(t), "")
+	rel := validRelease()
+	rel.SHA256 = ""
+	body, _ := json.Marshal(rel)
+
+	req := httptest.NewRequest(http.MethodPost, Prefix, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for missing sha256, got %d", w.Code)
+	}
+}
+
+func TestFrontendSubmitSuccess(t *testing.T) {
+	store := newTestStore(t)
+	f := NewFrontend(store, "")
+	body, _ := json.Marshal(validRelease())
+
+	req := httptest.NewRequest(http.MethodPost, Prefix, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+
+	got := store.List(ChannelStable, "linux")
+	if len(got) != 1 || got[0].Version != "1.3.0" {
+		t.Errorf("expected the submitted release to be persisted, got %+v", got)
+	}
+}
+
+func TestFrontendServeHTML(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Add(validRelease()); err != nil {
+		t.Fatal(err)
+	}
+	f := NewFrontend(store, "")
+
+	req := httptest.NewRequest(http.MethodGet, Prefix, nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected text/html content type, got %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "1.3.0") {
+		t.Errorf("expected rendered HTML to contain the release version, got %q", w.Body.String())
+	}
+}
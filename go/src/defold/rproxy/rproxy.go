@@ -0,0 +1,527 @@
+// Copyright 2020 The Defold Foundation
+// Licensed under the Defold License version 1.0 (the "License"); you may not use
+// this file except in compliance with the License.
+//
+// You may obtain a copy of the License, together with FAQs at
+// https://www.defold.com/license
+//
+// Unless required by applicable law or agreed to in writing, software distributed
+// under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied. See the License for the
+// specific language governing permissions and limitations under the License.
+
+// Command rproxy is the reverse proxy that fronts the dashboard, editor and
+// project services. Routing rules are read from a small text config file:
+// one rule per line, "<prefix> <target> [shadow=<target>] [cache=<duration>]".
+// The longest matching prefix wins; a rule with prefix "/" (or "") acts as
+// the default.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"defold/rproxy/dl"
+	"defold/rproxy/short"
+)
+
+var (
+	configFile = flag.String("config", "rproxy.config", "path to the routing config file")
+	addr       = flag.String("addr", ":8000", "address to listen on")
+	shortDB    = flag.String("short_db", "short.db", "path to the URL shortener's BoltDB file")
+	shortAuth  = flag.String("short_auth", "", "bearer token required to modify short links")
+	dlStore    = flag.String("dl_store", "downloads.json", "path to the downloads metadata JSON store")
+	dlAuth     = flag.String("dl_auth", "", "bearer token required to submit release metadata")
+)
+
+// rule is a single routing entry parsed from the config file.
+type rule struct {
+	prefix   string
+	target   *url.URL
+	shadow   *url.URL      // optional tee target; traffic is mirrored, not served, from here
+	cacheTTL time.Duration // optional; zero disables caching for this rule
+}
+
+// proxy is a reverse proxy that routes requests according to a table of
+// rules and optionally mirrors traffic to shadow backends. The rule table
+// is held in rulesVal so it can be swapped out by reload/Watch without
+// route() ever observing a torn read.
+type proxy struct {
+	configPath string
+	rulesVal   atomic.Value // holds []rule
+	tee        *teeLog
+	short      *short.Shortener // optional; nil disables the built-in shortener
+	dl         *dl.Frontend     // optional; nil disables the built-in downloads frontend
+	cache      *respCache
+}
+
+// newProxy builds a proxy from the rules in configFile.
+func newProxy(configFile string) (*proxy, error) {
+	p := &proxy{configPath: configFile, tee: newTeeLog(), cache: newRespCache()}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reload re-reads and validates p.configPath and, if it is well-formed,
+// atomically swaps it in as the active rule table. On error the previously
+// active table (if any) is left untouched.
+func (p *proxy) reload() error {
+	rules, err := loadRulesFile(p.configPath)
+	if err != nil {
+		return err
+	}
+	if err := validateRules(rules); err != nil {
+		return fmt.Errorf("rproxy: %s: %v", p.configPath, err)
+	}
+	p.rulesVal.Store(rules)
+	return nil
+}
+
+// loadRulesFile reads and parses the rule table at path.
+func loadRulesFile(path string) ([]rule, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("rproxy: reading %s: %v", path, err)
+	}
+	rules, err := parseConfig(bytes.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("rproxy: parsing %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// validateRules rejects rule tables that would shadow one another (two
+// rules for the same prefix, so route's choice between them would be
+// arbitrary) or that target something that isn't a reachable upstream.
+func validateRules(rules []rule) error {
+	seen := make(map[string]bool, len(rules))
+	for _, ru := range rules {
+		if seen[ru.prefix] {
+			return fmt.Errorf("duplicate rule for prefix %q", ru.prefix)
+		}
+		seen[ru.prefix] = true
+		if ru.target.Host == "" {
+			return fmt.Errorf("rule for prefix %q has no reachable target host: %v", ru.prefix, ru.target)
+		}
+		if ru.shadow != nil && ru.shadow.Host == "" {
+			return fmt.Errorf("rule for prefix %q has no reachable shadow host: %v", ru.prefix, ru.shadow)
+		}
+		if ru.cacheTTL < 0 {
+			return fmt.Errorf("rule for prefix %q has a negative cache ttl: %v", ru.prefix, ru.cacheTTL)
+		}
+	}
+	return nil
+}
+
+// rules returns the currently active rule table.
+func (p *proxy) rules() []rule {
+	v, _ := p.rulesVal.Load().([]rule)
+	return v
+}
+
+// Watch fsnotify-watches the directory containing p.configPath and reloads
+// whenever the file changes, until ctx is done. A reload that fails
+// validation is logged and the active rule table is left unchanged.
+func (p *proxy) Watch(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("rproxy: starting config watcher: %v", err)
+	}
+	if err := w.Add(filepath.Dir(p.configPath)); err != nil {
+		w.Close()
+		return fmt.Errorf("rproxy: watching %s: %v", p.configPath, err)
+	}
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != filepath.Clean(p.configPath) {
+					continue
+				}
+				if ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				if err := p.reload(); err != nil {
+					log.Printf("rproxy: config reload failed, keeping previous rules: %v", err)
+					continue
+				}
+				log.Printf("rproxy: reloaded config from %s", p.configPath)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("rproxy: config watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// handleReload serves the admin endpoint that triggers the same reload
+// Watch and SIGHUP use.
+func (p *proxy) handleReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// matchingRule returns the longest config rule matching path, the same one
+// route would use, without building the resulting backend URL. It is used
+// to decide precedence between a built-in handler and the route table.
+func (p *proxy) matchingRule(path string) *rule {
+	rules := p.rules()
+	for i, ru := range rules {
+		if strings.HasPrefix(path, ru.prefix) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// servesBuiltin reports whether the built-in handler mounted at
+// builtinPrefix should serve path, rather than the route table: it wins
+// unless a config rule matches a strictly more specific (longer) prefix.
+// The match is on a path-segment boundary, so e.g. builtinPrefix
+// "/downloads/api" does not also claim "/downloads/apikey.txt".
+func (p *proxy) servesBuiltin(path, builtinPrefix string) bool {
+	if !strings.HasPrefix(path, builtinPrefix) {
+		return false
+	}
+	if !strings.HasSuffix(builtinPrefix, "/") && len(path) > len(builtinPrefix) && path[len(builtinPrefix)] != '/' {
+		return false
+	}
+	ru := p.matchingRule(path)
+	return ru == nil || len(ru.prefix) <= len(builtinPrefix)
+}
+
+// parseConfig reads routing rules, one per line, in the form:
+//
+//	<prefix> <target> [shadow=<target>] [cache=<duration>]
+//
+// Blank lines and lines starting with # are ignored. Rules are returned
+// sorted by decreasing prefix length so route can match greedily.
+func parseConfig(r io.Reader) ([]rule, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var rules []rule
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected \"<prefix> <target>\", got %q", i+1, line)
+		}
+		target, err := url.Parse(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid target %q: %v", i+1, fields[1], err)
+		}
+		ru := rule{prefix: fields[0], target: target}
+		if ru.prefix == "/" {
+			ru.prefix = ""
+		}
+		for _, extra := range fields[2:] {
+			k, v, ok := strings.Cut(extra, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: malformed option %q", i+1, extra)
+			}
+			switch k {
+			case "shadow":
+				shadow, err := url.Parse(v)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid shadow %q: %v", i+1, v, err)
+				}
+				ru.shadow = shadow
+			case "cache":
+				ttl, err := time.ParseDuration(v)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid cache ttl %q: %v", i+1, v, err)
+				}
+				ru.cacheTTL = ttl
+			default:
+				return nil, fmt.Errorf("line %d: unknown option %q", i+1, k)
+			}
+		}
+		rules = append(rules, ru)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+	return rules, nil
+}
+
+// route finds the longest prefix rule matching u and returns the primary
+// backend to serve the request from and, if the rule configures one, the
+// shadow backend the request should also be mirrored to.
+func (p *proxy) route(u url.URL) (target, shadow *url.URL) {
+	for _, ru := range p.rules() {
+		if !strings.HasPrefix(u.Path, ru.prefix) {
+			continue
+		}
+		suffix := strings.TrimPrefix(u.Path, ru.prefix)
+		t := *ru.target
+		t.Path = ru.target.Path + suffix
+		t.RawQuery = u.RawQuery
+		if ru.shadow == nil {
+			return &t, nil
+		}
+		s := *ru.shadow
+		s.Path = ru.shadow.Path + suffix
+		s.RawQuery = u.RawQuery
+		return &t, &s
+	}
+	return nil, nil
+}
+
+// ServeHTTP routes req to its primary backend and, when the matched rule
+// configures one, mirrors a copy of the request to the shadow backend. The
+// built-in /s/ shortener and /downloads/api downloads frontend are each
+// consulted before the route table, but a user-defined rule that matches a
+// longer (more specific) prefix than the built-in always wins.
+func (p *proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if p.short != nil && p.servesBuiltin(req.URL.Path, short.Prefix) {
+		p.short.ServeHTTP(w, req)
+		return
+	}
+	if p.dl != nil && p.servesBuiltin(req.URL.Path, dl.Prefix) {
+		p.dl.ServeHTTP(w, req)
+		return
+	}
+	target, shadow := p.route(*req.URL)
+	if target == nil {
+		http.NotFound(w, req)
+		return
+	}
+	rp := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL = target
+			r.Host = target.Host
+		},
+	}
+	if ttl := p.cacheTTL(req.URL.Path); ttl > 0 && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		rp.Transport = &cachingTransport{rt: http.DefaultTransport, cache: p.cache, ttl: ttl}
+	}
+	if shadow == nil {
+		rp.ServeHTTP(w, req)
+		return
+	}
+
+	finish := p.tee.mirror(req, shadow)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	rp.ServeHTTP(rec, req)
+	finish(rec.status, time.Since(start).Milliseconds())
+}
+
+// statusRecorder wraps an http.ResponseWriter just to capture the status
+// code written through it, so ServeHTTP can report the primary response's
+// outcome to the shadow comparison without buffering its body.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// cacheTTL returns the cache TTL configured on the rule that route would
+// use for path, or zero if none is configured.
+func (p *proxy) cacheTTL(path string) time.Duration {
+	if ru := p.matchingRule(path); ru != nil {
+		return ru.cacheTTL
+	}
+	return 0
+}
+
+// teeResult is a single recorded comparison between a primary and shadow
+// response, as served to /proxy/teelog.
+type teeResult struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Shadow      string    `json:"shadow"`
+	PrimaryCode int       `json:"primary_code"`
+	ShadowCode  int       `json:"shadow_code"`
+	PrimaryMS   int64     `json:"primary_ms"`
+	ShadowMS    int64     `json:"shadow_ms"`
+	Diff        string    `json:"diff,omitempty"`
+}
+
+// teeLog records shadow comparisons in memory for the /proxy/teelog endpoint.
+// It is capped so a misbehaving shadow backend cannot grow it unbounded.
+type teeLog struct {
+	mu      sync.Mutex
+	results []teeResult
+}
+
+const teeLogLimit = 500
+
+func newTeeLog() *teeLog {
+	return &teeLog{}
+}
+
+// mirror starts replaying req against shadow in the background, leaving req
+// (and the primary response to it) untouched, and returns a function the
+// caller must invoke with the primary response's status code and latency
+// once it has been served. That function returns at once; a background
+// goroutine waits for the shadow response (or its error) and records the
+// completed primary/shadow comparison.
+func (tl *teeLog) mirror(req *http.Request, shadow *url.URL) func(primaryCode int, primaryMS int64) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return func(int, int64) {}
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	shadowReq := req.Clone(req.Context())
+	shadowReq.URL = shadow
+	shadowReq.Host = shadow.Host
+	shadowReq.RequestURI = ""
+	shadowReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	type shadowResult struct {
+		code int
+		ms   int64
+		err  error
+	}
+	shadowDone := make(chan shadowResult, 1)
+	start := time.Now()
+	go func() {
+		resp, err := http.DefaultClient.Do(shadowReq)
+		elapsed := time.Since(start)
+		if err != nil {
+			shadowDone <- shadowResult{ms: elapsed.Milliseconds(), err: err}
+			return
+		}
+		resp.Body.Close()
+		shadowDone <- shadowResult{code: resp.StatusCode, ms: elapsed.Milliseconds()}
+	}()
+
+	return func(primaryCode int, primaryMS int64) {
+		go func() {
+			sr := <-shadowDone
+			result := teeResult{
+				Time:        start,
+				Method:      req.Method,
+				Path:        req.URL.Path,
+				Shadow:      shadow.String(),
+				PrimaryCode: primaryCode,
+				PrimaryMS:   primaryMS,
+				ShadowMS:    sr.ms,
+			}
+			if sr.err != nil {
+				result.Diff = "shadow request failed: " + sr.err.Error()
+			} else {
+				result.ShadowCode = sr.code
+				if sr.code != primaryCode {
+					result.Diff = fmt.Sprintf("status differs: primary=%d shadow=%d", primaryCode, sr.code)
+				}
+			}
+			tl.add(result)
+		}()
+	}
+}
+
+func (tl *teeLog) add(r teeResult) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.results = append(tl.results, r)
+	if len(tl.results) > teeLogLimit {
+		tl.results = tl.results[len(tl.results)-teeLogLimit:]
+	}
+}
+
+// handleTeeLog serves the recorded shadow comparisons as JSON.
+func (tl *teeLog) handleTeeLog(w http.ResponseWriter, req *http.Request) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tl.results); err != nil {
+		log.Printf("rproxy: encoding teelog: %v", err)
+	}
+}
+
+func main() {
+	flag.Parse()
+	p, err := newProxy(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := short.OpenBoltStore(*shortDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.short = short.NewShortener(store, *shortAuth)
+
+	dlStoreHandle, err := dl.OpenStore(*dlStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.dl = dl.NewFrontend(dlStoreHandle, *dlAuth)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := p.Watch(ctx); err != nil {
+		log.Printf("rproxy: %v; config changes on disk will require SIGHUP or /proxy/reload", err)
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := p.reload(); err != nil {
+				log.Printf("rproxy: SIGHUP reload failed, keeping previous rules: %v", err)
+				continue
+			}
+			log.Printf("rproxy: reloaded config via SIGHUP")
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy/teelog", p.tee.handleTeeLog)
+	mux.HandleFunc("/proxy/reload", p.handleReload)
+	mux.HandleFunc("/proxy/cache/stats", p.cache.handleCacheStats)
+	mux.HandleFunc("/proxy/cache", p.cache.handleCacheInvalidate)
+	mux.Handle("/", p)
+	log.Printf("rproxy: listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
@@ -13,10 +13,35 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"defold/rproxy/dl"
+	"defold/rproxy/short"
 )
 
+// memStore is a trivial short.Store used only by these tests.
+type memStore map[string]string
+
+func (m memStore) Get(key string) (string, error) {
+	v, ok := m[key]
+	if !ok {
+		return "", short.ErrNotFound
+	}
+	return v, nil
+}
+
+func (m memStore) Put(key, longURL string) error { m[key] = longURL; return nil }
+func (m memStore) Delete(key string) error       { delete(m, key); return nil }
+
 func parse(u string) url.URL {
 	ur, err := url.Parse(u)
 	if err != nil {
@@ -60,13 +85,267 @@ func TestReverseProxy(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		u := rp.route(parse(tt.url))
+		u, shadow := rp.route(parse(tt.url))
+		if u == nil {
+			t.Errorf("nil route for %v", tt.url)
+			continue
+		}
+		e := parse(tt.expected)
+		if *u != e {
+			t.Errorf("expected %v, got %v", e, *u)
+		}
+		if shadow != nil {
+			t.Errorf("unexpected shadow route %v for %v", shadow, tt.url)
+		}
+	}
+}
+
+func TestReverseProxyShadow(t *testing.T) {
+	rp, err := newProxy("test.config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		url            string
+		expected       string
+		expectedShadow string
+	}{
+		{"http://localhost/shadowed", "http://localhost:8002", "http://localhost:8003"},
+		{"http://localhost/shadowed/a?x=1", "http://localhost:8002/a?x=1", "http://localhost:8003/a?x=1"},
+		{"http://localhost/prjs", "http://localhost:8001", ""},
+	}
+
+	for _, tt := range tests {
+		u, shadow := rp.route(parse(tt.url))
 		if u == nil {
 			t.Errorf("nil route for %v", tt.url)
+			continue
 		}
 		e := parse(tt.expected)
 		if *u != e {
 			t.Errorf("expected %v, got %v", e, *u)
 		}
+		if tt.expectedShadow == "" {
+			if shadow != nil {
+				t.Errorf("expected no shadow route for %v, got %v", tt.url, shadow)
+			}
+			continue
+		}
+		if shadow == nil {
+			t.Errorf("expected shadow route %v for %v, got none", tt.expectedShadow, tt.url)
+			continue
+		}
+		es := parse(tt.expectedShadow)
+		if *shadow != es {
+			t.Errorf("expected shadow %v, got %v", es, *shadow)
+		}
+	}
+}
+
+// TestReverseProxyShortPrecedence verifies that the built-in /s/ shortener
+// only serves a request when no more specific user-defined rule matches;
+// test.config defines /s/reserved as such a rule, so it must win over the
+// shortener even though it too falls under short.Prefix.
+func TestReverseProxyShortPrecedence(t *testing.T) {
+	rp, err := newProxy("test.config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := memStore{"go": "https://golang.org"}
+	rp.short = short.NewShortener(store, "")
+
+	// A known shortener key falls through to the shortener and redirects.
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/s/go", nil))
+	if w.Code != http.StatusFound {
+		t.Errorf("expected 302 for shortener key, got %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://golang.org" {
+		t.Errorf("expected redirect to https://golang.org, got %q", loc)
+	}
+
+	// /s/reserved is a more specific config rule than short.Prefix, so it
+	// must win precedence over the shortener regardless of what the
+	// shortener knows about the key.
+	if ru := rp.matchingRule("/s/reserved/x"); ru == nil || len(ru.prefix) <= len(short.Prefix) {
+		t.Errorf("expected /s/reserved/x to match a rule more specific than %q, got %v", short.Prefix, ru)
+	}
+}
+
+func TestValidateRulesRejectsDuplicatePrefix(t *testing.T) {
+	rules, err := parseConfig(strings.NewReader("/a http://localhost:8000\n/a http://localhost:8001\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateRules(rules); err == nil {
+		t.Error("expected a duplicate-prefix rule table to be rejected")
+	}
+}
+
+func TestValidateRulesRejectsUnreachableTarget(t *testing.T) {
+	rules, err := parseConfig(strings.NewReader("/a /just/a/path\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateRules(rules); err == nil {
+		t.Error("expected a target without a host to be rejected")
+	}
+}
+
+// TestReverseProxyHotReload rewrites the config file on disk and asserts
+// that route() observes the new rule table once Watch picks up the
+// change, while a concurrent reader keeps calling route() so -race can
+// catch any torn read of the table being swapped underneath it.
+func TestReverseProxyHotReload(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "test.config")
+	if err := ioutil.WriteFile(cfgPath, []byte("/ http://localhost:8000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := newProxy(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := rp.Watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				rp.route(parse("http://localhost/"))
+			}
+		}
+	}()
+	defer func() { close(stop); wg.Wait() }()
+
+	if err := ioutil.WriteFile(cfgPath, []byte("/ http://localhost:9000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		u, _ := rp.route(parse("http://localhost/"))
+		if u != nil && u.Port() == "9000" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("config reload did not take effect within the deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestReverseProxyShadowRecordsComparison verifies that a mirrored request
+// ends up in the teelog with both the primary and shadow outcomes recorded,
+// and that a status mismatch between them is surfaced as a diff.
+func TestReverseProxyShadowRecordsComparison(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer primary.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer shadow.Close()
+
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "test.config")
+	cfg := "/ " + primary.URL + " shadow=" + shadow.URL + "\n"
+	if err := ioutil.WriteFile(cfgPath, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rp, err := newProxy(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/x", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the primary response to reach the client, got %d", w.Code)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rp.tee.mu.Lock()
+		n := len(rp.tee.results)
+		var got teeResult
+		if n > 0 {
+			got = rp.tee.results[n-1]
+		}
+		rp.tee.mu.Unlock()
+		if n > 0 {
+			if got.PrimaryCode != http.StatusOK || got.ShadowCode != http.StatusTeapot {
+				t.Fatalf("expected primary=200 shadow=418, got %+v", got)
+			}
+			if got.Diff == "" {
+				t.Fatalf("expected a diff for mismatched statuses, got %+v", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shadow comparison was not recorded within the deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestReverseProxyDownloadsPrecedence verifies that the static "/downloads"
+// rule in test.config keeps resolving file paths to the static backend
+// while the more specific /downloads/api paths are handled internally by
+// the downloads frontend.
+func TestReverseProxyDownloadsPrecedence(t *testing.T) {
+	rp, err := newProxy("test.config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := dl.OpenStore(filepath.Join(t.TempDir(), "downloads.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.dl = dl.NewFrontend(store, "")
+
+	target, _ := rp.route(parse("http://localhost/downloads/file.txt"))
+	if target == nil || target.String() != "http://localhost:8080/downloads/file.txt" {
+		t.Errorf("expected static backend for /downloads/file.txt, got %v", target)
+	}
+	if rp.servesBuiltin("/downloads/file.txt", dl.Prefix) {
+		t.Error("expected the downloads frontend not to claim /downloads/file.txt")
+	}
+
+	if !rp.servesBuiltin("/downloads/api/list", dl.Prefix) {
+		t.Error("expected the downloads frontend to claim /downloads/api/list")
+	}
+
+	// A static file whose name merely starts with "api" must not be
+	// mistaken for the dl.Prefix path by a bare strings.HasPrefix check.
+	if target, _ := rp.route(parse("http://localhost/downloads/apikey.txt")); target == nil || target.String() != "http://localhost:8080/downloads/apikey.txt" {
+		t.Errorf("expected static backend for /downloads/apikey.txt, got %v", target)
+	}
+	if rp.servesBuiltin("/downloads/apikey.txt", dl.Prefix) {
+		t.Error("expected the downloads frontend not to claim /downloads/apikey.txt")
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/downloads/api/list?channel=stable&os=linux", nil)
+	rp.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 from the downloads API, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type from the downloads API, got %q", ct)
 	}
 }
@@ -0,0 +1,279 @@
+// Copyright 2020 The Defold Foundation
+// Licensed under the Defold License version 1.0 (the "License"); you may not use
+// this file except in compliance with the License.
+//
+// You may obtain a copy of the License, together with FAQs at
+// https://www.defold.com/license
+//
+// Unless required by applicable law or agreed to in writing, software distributed
+// under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied. See the License for the
+// specific language governing permissions and limitations under the License.
+
+// Package short implements the URL shortener rproxy mounts at Prefix.
+// Mappings are persisted through a pluggable Store, file-backed by BoltDB
+// by default, and resolutions are cached in-process so that the GET
+// redirect for a hot key is answered without a Store lookup. Writing the
+// redirect response itself (through http.Redirect) still allocates.
+package short
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "github.com/boltdb/bolt"
+)
+
+// Prefix is the path prefix rproxy mounts the shortener at.
+const Prefix = "/s/"
+
+var bucketName = []byte("short")
+
+// ErrNotFound is returned by Store.Get when key has no mapping.
+var ErrNotFound = errors.New("short: key not found")
+
+// Store persists key -> long URL mappings. BoltStore is the default,
+// file-backed implementation; a Redis- or memcache-backed Store can satisfy
+// the same interface for deployments that need to share state across
+// multiple rproxy instances.
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, longURL string) error
+	Delete(key string) error
+}
+
+// BoltStore is a Store backed by a local BoltDB file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens (creating if necessary) a BoltDB-backed Store at path.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("short: opening %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("short: creating bucket: %v", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(key string) (string, error) {
+	var longURL string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketName).Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		longURL = string(v)
+		return nil
+	})
+	return longURL, err
+}
+
+func (s *BoltStore) Put(key, longURL string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Put([]byte(key), []byte(longURL))
+	})
+}
+
+func (s *BoltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Delete([]byte(key))
+	})
+}
+
+// Close releases the underlying BoltDB file.
+func (s *BoltStore) Close() error { return s.db.Close() }
+
+// cacheEntry is one TTL-bounded resolution held by cache.
+type cacheEntry struct {
+	key     string
+	longURL string
+	expires time.Time
+}
+
+// cache is a fixed-size, TTL-bounded LRU cache of key -> long URL
+// resolutions, so a hot key's GET never touches the Store.
+type cache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newCache(capacity int, ttl time.Duration) *cache {
+	return &cache{
+		ttl:      ttl,
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *cache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return "", false
+	}
+	c.ll.MoveToFront(el)
+	return e.longURL, true
+}
+
+func (c *cache) put(key, longURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*cacheEntry).longURL = longURL
+		el.Value.(*cacheEntry).expires = time.Now().Add(c.ttl)
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&cacheEntry{key: key, longURL: longURL, expires: time.Now().Add(c.ttl)})
+	c.items[key] = el
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*cacheEntry).key)
+		}
+	}
+}
+
+func (c *cache) evict(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+const (
+	defaultCacheSize = 10000
+	defaultCacheTTL  = 5 * time.Minute
+)
+
+// Shortener serves GET redirects and an authenticated JSON API for
+// managing key -> long URL mappings.
+type Shortener struct {
+	store     Store
+	cache     *cache
+	authToken string
+}
+
+// NewShortener builds a Shortener backed by store. authToken, if non-empty,
+// must be presented as "Authorization: Bearer <authToken>" on POST and
+// DELETE requests; GET redirects are always unauthenticated.
+func NewShortener(store Store, authToken string) *Shortener {
+	return &Shortener{
+		store:     store,
+		cache:     newCache(defaultCacheSize, defaultCacheTTL),
+		authToken: authToken,
+	}
+}
+
+// ServeHTTP implements the shortener's routes: GET Prefix+key redirects
+// with 302 to the key's long URL (404 if unknown), POST with a JSON
+// {"key", "long_url"} body creates or updates a mapping (201), and DELETE
+// Prefix+key removes one (204).
+func (sh *Shortener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sh.serveRedirect(w, r)
+	case http.MethodPost:
+		sh.serveCreate(w, r)
+	case http.MethodDelete:
+		sh.serveDelete(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (sh *Shortener) serveRedirect(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, Prefix)
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if longURL, ok := sh.cache.get(key); ok {
+		http.Redirect(w, r, longURL, http.StatusFound)
+		return
+	}
+	longURL, err := sh.store.Get(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	sh.cache.put(key, longURL)
+	http.Redirect(w, r, longURL, http.StatusFound)
+}
+
+func (sh *Shortener) authorized(r *http.Request) bool {
+	if sh.authToken == "" {
+		return true
+	}
+	return r.Header.Get("Authorization") == "Bearer "+sh.authToken
+}
+
+type createRequest struct {
+	Key     string `json:"key"`
+	LongURL string `json:"long_url"`
+}
+
+func (sh *Shortener) serveCreate(w http.ResponseWriter, r *http.Request) {
+	if !sh.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req createRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" || req.LongURL == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := sh.store.Put(req.Key, req.LongURL); err != nil {
+		http.Error(w, "storing mapping: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sh.cache.put(req.Key, req.LongURL)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (sh *Shortener) serveDelete(w http.ResponseWriter, r *http.Request) {
+	if !sh.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, Prefix)
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := sh.store.Delete(key); err != nil {
+		http.Error(w, "deleting mapping: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sh.cache.evict(key)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 The Defold Foundation
+// Licensed under the Defold License version 1.0 (the "License"); you may not use
+// this file except in compliance with the License.
+//
+// You may obtain a copy of the License, together with FAQs at
+// https://www.defold.com/license
+//
+// Unless required by applicable law or agreed to in writing, software distributed
+// under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied. See the License for the
+// specific language governing permissions and limitations under the License.
+
+package short
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// memStore is a trivial in-memory Store used only by tests; production
+// deployments use BoltStore.
+type memStore struct {
+	mu   sync.Mutex
+	data map[string]string
+	gets int
+}
+
+func newMemStore() *memStore { return &memStore{data: make(map[string]string)} }
+
+func (m *memStore) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gets++
+	v, ok := m.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v, nil
+}
+
+func (m *memStore) Put(key, longURL string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = longURL
+	return nil
+}
+
+func (m *memStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+	return nil
+}
+
+func TestShortenerRedirectUsesCache(t *testing.T) {
+	store := newMemStore()
+	store.Put("go", "https://golang.org")
+	sh := NewShortener(store, "")
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, Prefix+"go", nil)
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, req)
+		if w.Code != http.StatusFound {
+			t.Fatalf("request %d: expected 302, got %d", i, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != "https://golang.org" {
+			t.Fatalf("request %d: expected redirect to https://golang.org, got %q", i, loc)
+		}
+	}
+	if store.gets != 1 {
+		t.Errorf("expected exactly 1 store lookup once cached, got %d", store.gets)
+	}
+}
+
+func TestShortenerInvalidKeyIs404(t *testing.T) {
+	sh := NewShortener(newMemStore(), "")
+	req := httptest.NewRequest(http.MethodGet, Prefix+"missing", nil)
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown key, got %d", w.Code)
+	}
+}
+
+func TestShortenerCreateRequiresAuth(t *testing.T) {
+	sh := NewShortener(newMemStore(), "secret")
+	body, _ := json.Marshal(createRequest{Key: "go", LongURL: "https://golang.org"})
+
+	req := httptest.NewRequest(http.MethodPost, Prefix, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without auth, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, Prefix, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 with auth, got %d", w.Code)
+	}
+}
+
+func TestShortenerDelete(t *testing.T) {
+	store := newMemStore()
+	store.Put("go", "https://golang.org")
+	sh := NewShortener(store, "")
+
+	req := httptest.NewRequest(http.MethodDelete, Prefix+"go", nil)
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, Prefix+"go", nil)
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", w.Code)
+	}
+}